@@ -0,0 +1,49 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/skygeario/skygear-server/pkg/server/skyconfig/auth"
+)
+
+// bootstrapKeysFromDeviceFlow runs the skyconfig/auth device
+// authorization flow and, on success, fills in App.APIKey and
+// App.MasterKey. It is invoked by ReadFrom when SKYCONFIG_AUTH_MODE=device
+// is set and no keys were found in any ConfigSource.
+func (config *Configuration) bootstrapKeysFromDeviceFlow() error {
+	if cached, ok, err := auth.LoadKeysCache(); err == nil && ok {
+		config.App.APIKey = cached.APIKey
+		config.App.MasterKey = cached.MasterKey
+		return nil
+	}
+
+	authURL := os.Getenv(auth.AuthURLEnv)
+	if authURL == "" {
+		return fmt.Errorf("%s is not set", auth.AuthURLEnv)
+	}
+
+	client := auth.NewClient(authURL, os.Getenv(auth.ClientIDEnv))
+	keys, err := client.Bootstrap()
+	if err != nil {
+		return err
+	}
+
+	config.App.APIKey = keys.APIKey
+	config.App.MasterKey = keys.MasterKey
+	return nil
+}
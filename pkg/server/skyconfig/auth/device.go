@@ -0,0 +1,244 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth implements OAuth 2.0 device authorization (RFC 8628) as a
+// way for a headless skygear process to obtain its App.APIKey and
+// App.MasterKey from a central identity endpoint instead of requiring
+// operators to type them into env vars. It is used by skyconfig when
+// SKYCONFIG_AUTH_MODE=device is set and API_KEY/MASTER_KEY are empty.
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Keys is the pair of keys obtained at the end of a successful device
+// authorization flow, and the shape cached at keysCachePath.
+type Keys struct {
+	APIKey    string `json:"api_key"`
+	MasterKey string `json:"master_key"`
+}
+
+// deviceCodeResponse is the response to POST {AuthURL}/device/code.
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	Interval        int    `json:"interval"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+// tokenResponse is the response to POST {AuthURL}/token. Error is an
+// OAuth error code such as "authorization_pending", "slow_down",
+// "access_denied" or "expired_token"; it is empty on success.
+type tokenResponse struct {
+	Error     string `json:"error"`
+	APIKey    string `json:"api_key"`
+	MasterKey string `json:"master_key"`
+}
+
+// Client drives the device authorization flow against AuthURL.
+type Client struct {
+	AuthURL  string
+	ClientID string
+
+	httpClient *http.Client
+}
+
+// NewClient returns a Client that talks to authURL (the value of
+// SKYCONFIG_AUTH_URL) as clientID.
+func NewClient(authURL, clientID string) *Client {
+	return &Client{AuthURL: authURL, ClientID: clientID, httpClient: http.DefaultClient}
+}
+
+// Bootstrap runs the full device authorization flow: it requests a
+// device code, prints the user code and verification URL to stderr, and
+// polls for completion. On success the resulting Keys are cached to
+// keysCachePath before being returned.
+func (client *Client) Bootstrap() (Keys, error) {
+	code, err := client.requestDeviceCode()
+	if err != nil {
+		return Keys{}, err
+	}
+
+	fmt.Fprintf(os.Stderr, "To authorize this install, visit %s and enter code: %s\n", code.VerificationURI, code.UserCode)
+
+	keys, err := client.poll(code)
+	if err != nil {
+		return Keys{}, err
+	}
+
+	if err := writeKeysCache(keys); err != nil {
+		// Caching is a convenience, not a requirement for this
+		// bootstrap to have succeeded.
+		fmt.Fprintf(os.Stderr, "skyconfig/auth: failed to cache keys: %v\n", err)
+	}
+	return keys, nil
+}
+
+func (client *Client) requestDeviceCode() (deviceCodeResponse, error) {
+	var code deviceCodeResponse
+	resp, err := client.httpClient.PostForm(client.AuthURL+"/device/code", url.Values{
+		"client_id": {client.ClientID},
+	})
+	if err != nil {
+		return code, fmt.Errorf("skyconfig/auth: device code request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return code, fmt.Errorf("skyconfig/auth: failed to parse device code response: %v", err)
+	}
+	if code.DeviceCode == "" {
+		return code, fmt.Errorf("skyconfig/auth: device code response missing device_code")
+	}
+	return code, nil
+}
+
+func (client *Client) poll(code deviceCodeResponse) (Keys, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for {
+		if code.ExpiresIn > 0 && time.Now().After(deadline) {
+			return Keys{}, fmt.Errorf("skyconfig/auth: device code expired before authorization completed")
+		}
+
+		time.Sleep(interval)
+
+		token, err := client.requestToken(code.DeviceCode)
+		if err != nil {
+			return Keys{}, err
+		}
+
+		switch token.Error {
+		case "":
+			return Keys{APIKey: token.APIKey, MasterKey: token.MasterKey}, nil
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval *= 2
+			continue
+		case "access_denied":
+			return Keys{}, fmt.Errorf("skyconfig/auth: authorization was denied")
+		case "expired_token":
+			return Keys{}, fmt.Errorf("skyconfig/auth: device code expired")
+		default:
+			return Keys{}, fmt.Errorf("skyconfig/auth: unexpected OAuth error %q", token.Error)
+		}
+	}
+}
+
+func (client *Client) requestToken(deviceCode string) (tokenResponse, error) {
+	var token tokenResponse
+	resp, err := client.httpClient.PostForm(client.AuthURL+"/token", url.Values{
+		"grant_type":  {deviceGrantType},
+		"device_code": {deviceCode},
+		"client_id":   {client.ClientID},
+	})
+	if err != nil {
+		return token, fmt.Errorf("skyconfig/auth: token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return token, fmt.Errorf("skyconfig/auth: failed to parse token response: %v", err)
+	}
+	return token, nil
+}
+
+// Refresh re-runs Bootstrap, intended to be called after the cached keys
+// are rejected with a 401 by the Skygear server.
+func (client *Client) Refresh() (Keys, error) {
+	return client.Bootstrap()
+}
+
+func keysCachePath() (string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("skyconfig/auth: cannot determine config directory: %v", err)
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "skygear", "keys.json"), nil
+}
+
+func writeKeysCache(keys Keys) error {
+	path, err := keysCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// LoadKeysCache reads the keys cached by a previous Bootstrap, if any.
+func LoadKeysCache() (Keys, bool, error) {
+	path, err := keysCachePath()
+	if err != nil {
+		return Keys{}, false, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Keys{}, false, nil
+	}
+	if err != nil {
+		return Keys{}, false, err
+	}
+
+	var keys Keys
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return Keys{}, false, fmt.Errorf("skyconfig/auth: failed to parse cached keys at %s: %v", path, err)
+	}
+	return keys, true, nil
+}
+
+// Enabled reports whether SKYCONFIG_AUTH_MODE requests the device flow
+// and API_KEY/MASTER_KEY have not already been supplied, per the
+// triggering condition this package implements.
+func Enabled() bool {
+	return os.Getenv("SKYCONFIG_AUTH_MODE") == "device" &&
+		os.Getenv("API_KEY") == "" &&
+		os.Getenv("MASTER_KEY") == ""
+}
+
+// ClientIDEnv is the environment variable carrying the OAuth client id
+// used in the device/code and token requests.
+const ClientIDEnv = "SKYCONFIG_AUTH_CLIENT_ID"
+
+// AuthURLEnv is the environment variable carrying the base URL of the
+// device authorization endpoint, e.g. SKYCONFIG_AUTH_URL=https://id.example.com/oauth.
+const AuthURLEnv = "SKYCONFIG_AUTH_URL"
@@ -18,12 +18,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
 
-	"github.com/joho/godotenv"
 	"github.com/skygeario/skygear-server/pkg/server/uuid"
 )
 
@@ -47,11 +45,13 @@ type PluginConfig struct {
 	Args      []string
 }
 
-// Configuration is Skygear's configuration
-// The configuration will load in following order:
-// 1. The ENV
-// 2. The key/value in .env file
-// 3. The config in *.ini (To-be depreacted)
+// Configuration is Skygear's configuration. ReadFromEnv loads it from a
+// .env file layered under the process environment; LoadFile loads it
+// from a structured YAML or TOML file first, with that file's own
+// includes, then .env, then the process environment each taking
+// precedence over the last. See ReadFrom in source.go for the general
+// form both are built on, and Provenance for where each field's value
+// came from.
 type Configuration struct {
 	HTTP struct {
 		Host string `json:"host"`
@@ -59,7 +59,7 @@ type Configuration struct {
 	App struct {
 		Name          string `json:"name"`
 		APIKey        string `json:"api_key"`
-		MasterKey     string `json:"master_key"`
+		MasterKey     string `json:"master_key" secret:"true"`
 		AccessControl string `json:"access_control"`
 		DevMode       bool   `json:"dev_mode"`
 		CORSHost      string `json:"cors_host"`
@@ -74,7 +74,7 @@ type Configuration struct {
 		Path     string `json:"path"`
 		Prefix   string `json:"prefix"`
 		Expiry   int64  `json:"expiry"`
-		Secret   string `json:"secret"`
+		Secret   string `json:"secret" secret:"true"`
 	} `json:"-"`
 	AssetStore struct {
 		ImplName string `json:"implementation"`
@@ -85,7 +85,7 @@ type Configuration struct {
 
 		// followings only used when ImplName = s3
 		AccessToken string `json:"access_key"`
-		SecretToken string `json:"secret_key"`
+		SecretToken string `json:"secret_key" secret:"true"`
 		Region      string `json:"region"`
 		Bucket      string `json:"bucket"`
 
@@ -103,13 +103,13 @@ type Configuration struct {
 		Enable   bool   `json:"enable"`
 		Env      string `json:"env"`
 		Cert     string `json:"cert"`
-		Key      string `json:"key"`
+		Key      string `json:"key" secret:"true"`
 		CertPath string `json:"-"`
 		KeyPath  string `json:"-"`
 	} `json:"apns"`
 	GCM struct {
 		Enable bool   `json:"enable"`
-		APIKey string `json:"api_key"`
+		APIKey string `json:"api_key" secret:"true"`
 	} `json:"gcm"`
 	LOG struct {
 		Level        string            `json:"-"`
@@ -120,6 +120,16 @@ type Configuration struct {
 		SentryLevel string
 	} `json:"-"`
 	Plugin map[string]*PluginConfig `json:"-"`
+
+	// historyStore, when set via SetHistoryStore, receives a HistoryEntry
+	// every time Commit observes a change. See history.go.
+	historyStore ConfigHistoryStore
+
+	// runtime holds the mutable, lock-guarded state ReadFrom/Reload need
+	// (source.go). It is a pointer, rather than an embedded sync.RWMutex,
+	// so that Configuration remains safe to copy by value as
+	// NewConfiguration and RestoreHistory both do.
+	runtime *configRuntime
 }
 
 func NewConfiguration() Configuration {
@@ -156,7 +166,17 @@ func NewConfigurationWithKeys() Configuration {
 	return config
 }
 
-func (config *Configuration) Validate() error {
+// appNamePattern is shared between Validate and the App.Name FieldSpec in
+// fields.go.
+var appNamePattern = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+// Validate checks the base configuration, then, for each override (see
+// AppOverride in tenant.go), that it does not shadow a reserved
+// transport-layer field. Passing overrides here, rather than requiring
+// every caller to also call ValidateOverride, lets admin tooling that
+// writes an _app_config row apply the same ValidateOverride check that
+// Registry.reload applies to every row it loads.
+func (config *Configuration) Validate(overrides ...AppOverride) error {
 	if config.App.Name == "" {
 		return errors.New("APP_NAME is not set")
 	}
@@ -166,190 +186,53 @@ func (config *Configuration) Validate() error {
 	if config.App.MasterKey == "" {
 		return errors.New("MASTER_KEY is not set")
 	}
-	if !regexp.MustCompile("^[A-Za-z0-9_]+$").MatchString(config.App.Name) {
-		return fmt.Errorf("APP_NAME '%s' contains invalid characters other than alphanumerics or underscores", config.App.Name)
+	if err := validateAppName(config.App.Name); err != nil {
+		return fmt.Errorf("APP_NAME %v", err)
 	}
 	if config.APNS.Enable && !regexp.MustCompile("^(sandbox|production)$").MatchString(config.APNS.Env) {
 		return fmt.Errorf("APNS_ENV must be sandbox or production")
 	}
+	for _, override := range overrides {
+		if err := ValidateOverride(override); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// ReadFromEnv populates the configuration from a .env file (if present)
+// layered under the process environment. It is a convenience wrapper
+// around ReadFrom(DefaultSources()...); call ReadFrom directly to layer
+// in a remote ConfigSource such as Consul, etcd or Vault (see source.go).
 func (config *Configuration) ReadFromEnv() {
-	envErr := godotenv.Load()
-	if envErr != nil {
-		log.Print("Error in loading .env file")
-	}
-
-	config.readHost()
-
-	appAPIKey := os.Getenv("API_KEY")
-	if appAPIKey != "" {
-		config.App.APIKey = appAPIKey
-	}
-
-	appMasterKey := os.Getenv("MASTER_KEY")
-	if appMasterKey != "" {
-		config.App.MasterKey = appMasterKey
-	}
-
-	appName := os.Getenv("APP_NAME")
-	if appName != "" {
-		config.App.Name = appName
-	}
-
-	corsHost := os.Getenv("CORS_HOST")
-	if corsHost != "" {
-		config.App.CORSHost = corsHost
-	}
-
-	accessControl := os.Getenv("ACCESS_CONRTOL")
-	if accessControl != "" {
-		config.App.AccessControl = accessControl
-	}
-
-	if devMode, err := parseBool(os.Getenv("DEV_MODE")); err == nil {
-		config.App.DevMode = devMode
+	if err := config.ReadFrom(DefaultSources()...); err != nil {
+		log.Print(err)
 	}
-
-	dbImplName := os.Getenv("DB_IMPL_NAME")
-	if dbImplName != "" {
-		config.DB.ImplName = dbImplName
-	}
-
-	if config.DB.ImplName == "pq" && os.Getenv("DATABASE_URL") != "" {
-		config.DB.Option = os.Getenv("DATABASE_URL")
-	}
-
-	if slave, err := parseBool(os.Getenv("SLAVE")); err == nil {
-		config.App.Slave = slave
-	}
-
-	config.readTokenStore()
-	config.readAssetStore()
-	config.readAPNS()
-	config.readGCM()
-	config.readLog()
-	config.readPlugins()
 }
 
 func (config *Configuration) readHost() {
 	// Default to :3000 if both HOST and PORT is missing
-	host := os.Getenv("HOST")
+	host := config.lookupEnv("HOST")
 	if host != "" {
 		config.HTTP.Host = host
 	}
 	if config.HTTP.Host == "" {
-		port := os.Getenv("PORT")
+		port := config.lookupEnv("PORT")
 		if port != "" {
 			config.HTTP.Host = ":" + port
 		}
 	}
 }
 
-func (config *Configuration) readTokenStore() {
-	tokenStore := os.Getenv("TOKEN_STORE")
-	if tokenStore != "" {
-		config.TokenStore.ImplName = tokenStore
-	}
-	tokenStorePath := os.Getenv("TOKEN_STORE_PATH")
-	if tokenStorePath != "" {
-		config.TokenStore.Path = tokenStorePath
-	}
-
-	tokenStorePrefix := os.Getenv("TOKEN_STORE_PREFIX")
-	if tokenStorePrefix != "" {
-		config.TokenStore.Prefix = tokenStorePrefix
-	}
-
-	if expiry, err := strconv.ParseInt(os.Getenv("TOKEN_STORE_EXPIRY"), 10, 64); err == nil {
-		config.TokenStore.Expiry = expiry
-	}
-
-	tokenStoreSecret := os.Getenv("TOKEN_STORE_SECRET")
-	if tokenStoreSecret != "" {
-		config.TokenStore.Secret = tokenStoreSecret
-	} else {
-		config.TokenStore.Secret = config.App.MasterKey
-	}
-}
-
-func (config *Configuration) readAssetStore() {
-	assetStore := os.Getenv("ASSET_STORE")
-	if assetStore != "" {
-		config.AssetStore.ImplName = assetStore
-	}
-
-	if assetStorePublic, err := parseBool(os.Getenv("ASSET_STORE_PUBLIC")); err == nil {
-		config.AssetStore.Public = assetStorePublic
-	}
-
-	// Local Storage related
-	assetStorePath := os.Getenv("ASSET_STORE_PATH")
-	if assetStorePath != "" {
-		config.AssetStore.Path = assetStorePath
-	}
-	assetStorePrefix := os.Getenv("ASSET_STORE_URL_PREFIX")
-	if assetStorePrefix != "" {
-		config.AssetURLSigner.URLPrefix = assetStorePrefix
-	}
-	assetStoreSecret := os.Getenv("ASSET_STORE_SECRET")
-	if assetStoreSecret != "" {
-		config.AssetURLSigner.Secret = assetStoreSecret
-	}
-
-	// S3 related
-	assetStoreAccessKey := os.Getenv("ASSET_STORE_ACCESS_KEY")
-	if assetStoreAccessKey != "" {
-		config.AssetStore.AccessToken = assetStoreAccessKey
-	}
-	assetStoreSecretKey := os.Getenv("ASSET_STORE_SECRET_KEY")
-	if assetStoreSecretKey != "" {
-		config.AssetStore.SecretToken = assetStoreSecretKey
-	}
-	assetStoreRegion := os.Getenv("ASSET_STORE_REGION")
-	if assetStoreRegion != "" {
-		config.AssetStore.Region = assetStoreRegion
-	}
-	assetStoreBucket := os.Getenv("ASSET_STORE_BUCKET")
-	if assetStoreBucket != "" {
-		config.AssetStore.Bucket = assetStoreBucket
-	}
-
-	// Cloud Asset related
-	cloudAssetHost := os.Getenv("CLOUD_ASSET_HOST")
-	if cloudAssetHost != "" {
-		config.AssetStore.CloudAssetHost = cloudAssetHost
-	}
-	cloudAssetToken := os.Getenv("CLOUD_ASSET_TOKEN")
-	if cloudAssetToken != "" {
-		config.AssetStore.CloudAssetToken = cloudAssetToken
-	}
-	cloudAssetPublicPrefix := os.Getenv("CLOUD_ASSET_PUBLIC_PREFIX")
-	if cloudAssetPublicPrefix != "" {
-		config.AssetStore.CloudAssetPublicPrefix = cloudAssetPublicPrefix
-	}
-	cloudAssetPrivatePrefix := os.Getenv("CLOUD_ASSET_PRIVATE_PREFIX")
-	if cloudAssetPrivatePrefix != "" {
-		config.AssetStore.CloudAssetPrivatePrefix = cloudAssetPrivatePrefix
-	}
-}
-
+// readAPNS reads the fields that only make sense once push notifications
+// are enabled; APNS.Enable and APNS.Env themselves are read earlier, as
+// part of the Fields registry pass.
 func (config *Configuration) readAPNS() {
-	if shouldEnableAPNS, err := parseBool(os.Getenv("APNS_ENABLE")); err == nil {
-		config.APNS.Enable = shouldEnableAPNS
-	}
-
 	if !config.APNS.Enable {
 		return
 	}
 
-	env := os.Getenv("APNS_ENV")
-	if env != "" {
-		config.APNS.Env = env
-	}
-
-	cert, key := os.Getenv("APNS_CERTIFICATE"), os.Getenv("APNS_PRIVATE_KEY")
+	cert, key := config.lookupEnv("APNS_CERTIFICATE"), config.lookupEnv("APNS_PRIVATE_KEY")
 	if cert != "" {
 		config.APNS.Cert = cert
 	}
@@ -357,57 +240,40 @@ func (config *Configuration) readAPNS() {
 		config.APNS.Key = key
 	}
 
-	certPath, keyPath := os.Getenv("APNS_CERTIFICATE_PATH"), os.Getenv("APNS_PRIVATE_KEY_PATH")
+	certPath, keyPath := config.lookupEnv("APNS_CERTIFICATE_PATH"), config.lookupEnv("APNS_PRIVATE_KEY_PATH")
 	if certPath != "" {
 		config.APNS.CertPath = certPath
 	}
 	if keyPath != "" {
 		config.APNS.KeyPath = keyPath
 	}
-
-}
-
-func (config *Configuration) readGCM() {
-	if shouldEnableGCM, err := parseBool(os.Getenv("GCM_ENABLE")); err == nil {
-		config.GCM.Enable = shouldEnableGCM
-	}
-
-	gcmAPIKey := os.Getenv("GCM_APIKEY")
-	if gcmAPIKey != "" {
-		config.GCM.APIKey = gcmAPIKey
-	}
 }
 
+// readLog reads the LOG_LEVEL_* family of per-logger overrides and the
+// Sentry log hook settings; LOG.Level itself is read as part of the
+// Fields registry pass.
 func (config *Configuration) readLog() {
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel != "" {
-		config.LOG.Level = logLevel
-	}
-
-	for _, environ := range os.Environ() {
-		if !strings.HasPrefix(environ, "LOG_LEVEL_") {
+	for key, value := range config.mergedEnv() {
+		if !strings.HasPrefix(key, "LOG_LEVEL_") {
 			continue
 		}
-
-		components := strings.SplitN(environ, "=", 2)
-		loggerName := strings.ToLower(strings.TrimPrefix(components[0], "LOG_LEVEL_"))
-		loggerLevel := components[1]
-		config.LOG.LoggersLevel[loggerName] = loggerLevel
+		loggerName := strings.ToLower(strings.TrimPrefix(key, "LOG_LEVEL_"))
+		config.LOG.LoggersLevel[loggerName] = value
 	}
 
-	sentry := os.Getenv("SENTRY_DSN")
+	sentry := config.lookupEnv("SENTRY_DSN")
 	if sentry != "" {
 		config.LogHook.SentryDSN = sentry
 	}
 
-	sentryLevel := os.Getenv("SENTRY_LEVEL")
+	sentryLevel := config.lookupEnv("SENTRY_LEVEL")
 	if sentryLevel != "" {
 		config.LogHook.SentryLevel = sentryLevel
 	}
 }
 
 func (config *Configuration) readPlugins() {
-	plugin := os.Getenv("PLUGINS")
+	plugin := config.lookupEnv("PLUGINS")
 	if plugin == "" {
 		return
 	}
@@ -415,9 +281,9 @@ func (config *Configuration) readPlugins() {
 	plugins := strings.Split(plugin, ",")
 	for _, p := range plugins {
 		pluginConfig := &PluginConfig{}
-		pluginConfig.Transport = os.Getenv(p + "_TRANSPORT")
-		pluginConfig.Path = os.Getenv(p + "_PATH")
-		args := os.Getenv(p + "_ARGS")
+		pluginConfig.Transport = config.lookupEnv(p + "_TRANSPORT")
+		pluginConfig.Path = config.lookupEnv(p + "_PATH")
+		args := config.lookupEnv(p + "_ARGS")
 		if args != "" {
 			pluginConfig.Args = strings.Split(args, ",")
 		}
@@ -0,0 +1,106 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ConsulConfigSource loads configuration from a Consul KV prefix, with
+// each key under Prefix mapped to the env var name obtained by
+// upper-casing its last path segment, e.g. "skygear/config/api_key" ->
+// "API_KEY".
+type ConsulConfigSource struct {
+	Client *consulapi.Client
+	Prefix string
+}
+
+// NewConsulConfigSource dials addr (e.g. "127.0.0.1:8500") and returns a
+// source reading keys under prefix.
+func NewConsulConfigSource(addr string, prefix string) (*ConsulConfigSource, error) {
+	cfg := consulapi.DefaultConfig()
+	cfg.Address = addr
+	client, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("skyconfig: failed to create consul client: %v", err)
+	}
+	return &ConsulConfigSource{Client: client, Prefix: prefix}, nil
+}
+
+func (source *ConsulConfigSource) envName(key string) string {
+	trimmed := strings.TrimPrefix(key, source.Prefix+"/")
+	segments := strings.Split(trimmed, "/")
+	return strings.ToUpper(segments[len(segments)-1])
+}
+
+func (source *ConsulConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	pairs, _, err := source.Client.KV().List(source.Prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("skyconfig: consul KV list failed: %v", err)
+	}
+
+	values := map[string]string{}
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			continue
+		}
+		values[source.envName(pair.Key)] = string(pair.Value)
+	}
+	return values, nil
+}
+
+// Watch blocks on a Consul blocking query against Prefix, emitting
+// EventChanged whenever the KV prefix's ModifyIndex advances.
+func (source *ConsulConfigSource) Watch(ctx context.Context) (<-chan Event, error) {
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+		var lastIndex uint64
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			_, meta, err := source.Client.KV().List(source.Prefix, (&consulapi.QueryOptions{
+				WaitIndex: lastIndex,
+			}).WithContext(ctx))
+			if err != nil {
+				select {
+				case events <- Event{Type: EventError, Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			if lastIndex != 0 && meta.LastIndex != lastIndex {
+				select {
+				case events <- Event{Type: EventChanged}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			lastIndex = meta.LastIndex
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// debugConfigResponse is the body served by DebugConfigHandler. Config
+// is a configSnapshotView rather than Configuration itself, since
+// Configuration's own json:"-" tags (TokenStore, AssetStore.Path, APNS
+// cert/key paths, LOG, LogHook, Plugin) exist to keep those fields out
+// of logs, not out of this endpoint - an operator asking /_debug/config
+// for the resolved configuration wants to see them, redacted rather
+// than hidden.
+type debugConfigResponse struct {
+	Config     configSnapshotView `json:"config"`
+	Provenance Provenance         `json:"provenance"`
+}
+
+// DebugConfigHandler serves the current configuration - every field,
+// including ones Configuration's MarshalJSON would normally hide behind
+// `json:"-"` - with every `secret:"true"` field redacted to "***",
+// alongside its Provenance. Mount it at /_debug/config behind whatever
+// authentication guards other admin-only routes.
+func (config *Configuration) DebugConfigHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view := newConfigSnapshotView(config)
+		redactSecretFields(reflect.ValueOf(&view))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(debugConfigResponse{
+			Config:     view,
+			Provenance: config.Provenance(),
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestDebugConfigHandlerExposesHiddenFieldsRedacted verifies
+// /_debug/config surfaces fields Configuration's own json:"-" tags hide
+// from ordinary marshalling (TokenStore.Path here), while still
+// redacting secret:"true" fields instead of leaking them.
+func TestDebugConfigHandlerExposesHiddenFieldsRedacted(t *testing.T) {
+	config := newTestConfig()
+
+	recorder := httptest.NewRecorder()
+	config.DebugConfigHandler()(recorder, httptest.NewRequest("GET", "/_debug/config", nil))
+
+	var body debugConfigResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode debug response: %v", err)
+	}
+
+	if body.Config.TokenStore.Path != "data/token" {
+		t.Errorf("expected TokenStore.Path (json:\"-\" on Configuration) to be visible, got %q", body.Config.TokenStore.Path)
+	}
+	if body.Config.App.MasterKey != redactedPlaceholder {
+		t.Errorf("expected MasterKey redacted, got %q", body.Config.App.MasterKey)
+	}
+	if body.Config.TokenStore.Secret != redactedPlaceholder {
+		t.Errorf("expected TokenStore.Secret redacted, got %q", body.Config.TokenStore.Secret)
+	}
+}
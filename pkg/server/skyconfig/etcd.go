@@ -0,0 +1,90 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/clientv3"
+)
+
+// EtcdConfigSource loads configuration from an etcd v3 key prefix, with
+// each key under Prefix mapped to the env var name obtained by
+// upper-casing its last path segment, analogous to ConsulConfigSource.
+type EtcdConfigSource struct {
+	Client *clientv3.Client
+	Prefix string
+}
+
+// NewEtcdConfigSource dials the given etcd endpoints and returns a
+// source reading keys under prefix.
+func NewEtcdConfigSource(endpoints []string, prefix string) (*EtcdConfigSource, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
+	if err != nil {
+		return nil, fmt.Errorf("skyconfig: failed to create etcd client: %v", err)
+	}
+	return &EtcdConfigSource{Client: client, Prefix: prefix}, nil
+}
+
+func (source *EtcdConfigSource) envName(key string) string {
+	trimmed := strings.TrimPrefix(key, source.Prefix+"/")
+	segments := strings.Split(trimmed, "/")
+	return strings.ToUpper(segments[len(segments)-1])
+}
+
+func (source *EtcdConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	resp, err := source.Client.Get(ctx, source.Prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("skyconfig: etcd get failed: %v", err)
+	}
+
+	values := map[string]string{}
+	for _, kv := range resp.Kvs {
+		values[source.envName(string(kv.Key))] = string(kv.Value)
+	}
+	return values, nil
+}
+
+// Watch streams etcd's native watch for Prefix, collapsing every batch
+// of key events into a single EventChanged.
+func (source *EtcdConfigSource) Watch(ctx context.Context) (<-chan Event, error) {
+	events := make(chan Event)
+	watchChan := source.Client.Watch(ctx, source.Prefix, clientv3.WithPrefix())
+
+	go func() {
+		defer close(events)
+		for resp := range watchChan {
+			if err := resp.Err(); err != nil {
+				select {
+				case events <- Event{Type: EventError, Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if len(resp.Events) == 0 {
+				continue
+			}
+			select {
+			case events <- Event{Type: EventChanged}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldSpec declares how a single Configuration field is read from the
+// environment: its canonical env var, any deprecated aliases that should
+// still be honoured (with a warning), a default, operator-facing help
+// text, an optional enum of accepted values, and a validator run on the
+// raw string value before it is parsed into the field. Path is a dotted Go field path relative to
+// Configuration, e.g. "App.APIKey".
+type FieldSpec struct {
+	Path      string
+	Env       string
+	LegacyEnv []string
+	Default   string
+	Help      string
+	Enum      []string
+	Validate  func(string) error
+}
+
+// Fields is the declarative registry ReadFromEnv walks to populate
+// Configuration. Fields whose resolution depends on another field's
+// value (HTTP.Host, DB.Option, TokenStore.Secret, APNS's cert/key
+// fields) are read outside the registry; see the read* helpers in
+// config.go.
+var Fields = []FieldSpec{
+	{Path: "App.Name", Env: "APP_NAME", Help: "Application name, used as the default DB namespace.", Validate: validateAppName},
+	{Path: "App.APIKey", Env: "API_KEY", Help: "API key required of every client request."},
+	{Path: "App.MasterKey", Env: "MASTER_KEY", Help: "Master key granting full access, never exposed to clients."},
+	{Path: "App.AccessControl", Env: "ACCESS_CONTROL", LegacyEnv: []string{"ACCESS_CONRTOL"}, Default: "role", Help: "Default record access control scheme."},
+	{Path: "App.DevMode", Env: "DEV_MODE", Default: "true", Help: "Enables developer-friendly behaviour such as implicit schema migration."},
+	{Path: "App.CORSHost", Env: "CORS_HOST", Default: "*", Help: "Allowed Origin for CORS requests."},
+	{Path: "App.Slave", Env: "SLAVE", Default: "false", Help: "Runs this process as a slave serving only plugin-registered lanes."},
+	{Path: "DB.ImplName", Env: "DB_IMPL_NAME", Default: "pq", Help: "Database backend implementation name."},
+	{Path: "TokenStore.ImplName", Env: "TOKEN_STORE", Default: "fs", Help: "Token store backend implementation name."},
+	{Path: "TokenStore.Path", Env: "TOKEN_STORE_PATH", Default: "data/token", Help: "Filesystem path used by the fs token store."},
+	{Path: "TokenStore.Prefix", Env: "TOKEN_STORE_PREFIX", Help: "Key prefix used by keyed token stores such as redis."},
+	{Path: "TokenStore.Expiry", Env: "TOKEN_STORE_EXPIRY", Default: "0", Help: "Access token expiry in seconds, 0 means no expiry."},
+	{Path: "AssetStore.ImplName", Env: "ASSET_STORE", Default: "fs", Help: "Asset store backend implementation name.", Enum: []string{"fs", "s3", "cloud"}},
+	{Path: "AssetStore.Public", Env: "ASSET_STORE_PUBLIC", Default: "false", Help: "Serves assets without a signed URL."},
+	{Path: "AssetStore.Path", Env: "ASSET_STORE_PATH", Default: "data/asset", Help: "Filesystem path used by the fs asset store."},
+	{Path: "AssetURLSigner.URLPrefix", Env: "ASSET_STORE_URL_PREFIX", Default: "http://localhost:3000/files", Help: "URL prefix under which signed asset URLs are served."},
+	{Path: "AssetURLSigner.Secret", Env: "ASSET_STORE_SECRET", Help: "Secret used to sign asset URLs.", Enum: nil},
+	{Path: "AssetStore.AccessToken", Env: "ASSET_STORE_ACCESS_KEY", Help: "S3 access key, used when ASSET_STORE=s3."},
+	{Path: "AssetStore.SecretToken", Env: "ASSET_STORE_SECRET_KEY", Help: "S3 secret key, used when ASSET_STORE=s3."},
+	{Path: "AssetStore.Region", Env: "ASSET_STORE_REGION", Help: "S3 region, used when ASSET_STORE=s3."},
+	{Path: "AssetStore.Bucket", Env: "ASSET_STORE_BUCKET", Help: "S3 bucket, used when ASSET_STORE=s3."},
+	{Path: "AssetStore.CloudAssetHost", Env: "CLOUD_ASSET_HOST", Help: "Upstream host, used when ASSET_STORE=cloud."},
+	{Path: "AssetStore.CloudAssetToken", Env: "CLOUD_ASSET_TOKEN", Help: "Upstream auth token, used when ASSET_STORE=cloud."},
+	{Path: "AssetStore.CloudAssetPublicPrefix", Env: "CLOUD_ASSET_PUBLIC_PREFIX", Help: "Public URL prefix, used when ASSET_STORE=cloud."},
+	{Path: "AssetStore.CloudAssetPrivatePrefix", Env: "CLOUD_ASSET_PRIVATE_PREFIX", Help: "Private URL prefix, used when ASSET_STORE=cloud."},
+	{Path: "APNS.Enable", Env: "APNS_ENABLE", Default: "false", Help: "Enables push notifications via Apple Push Notification service."},
+	{Path: "APNS.Env", Env: "APNS_ENV", Default: "sandbox", Help: "APNS gateway to use.", Enum: []string{"sandbox", "production"}},
+	{Path: "GCM.Enable", Env: "GCM_ENABLE", Default: "false", Help: "Enables push notifications via Google Cloud Messaging."},
+	{Path: "GCM.APIKey", Env: "GCM_APIKEY", Help: "GCM server API key."},
+	{Path: "LOG.Level", Env: "LOG_LEVEL", Default: "debug", Help: "Default log level for loggers without a per-logger override."},
+}
+
+func validateAppName(value string) error {
+	if !appNamePattern.MatchString(value) {
+		return fmt.Errorf("'%s' contains invalid characters other than alphanumerics or underscores", value)
+	}
+	return nil
+}
+
+// warnedLegacyEnv tracks which legacy env vars have already triggered a
+// deprecation warning this process, so ReadFromEnv (which may be called
+// more than once in tests) does not spam the log.
+var warnedLegacyEnv = map[string]bool{}
+
+// resolveSpec returns the raw string value for spec, preferring its
+// canonical env var, then falling back to LegacyEnv aliases in order
+// (logging a deprecation warning the first time an alias is used), then
+// Default. lookup is config.lookupEnv, which consults the merged
+// ConfigSource values when ReadFrom has populated them and falls back to
+// os.Getenv otherwise. The bool return reports whether any source other
+// than Default produced the value.
+func resolveSpec(spec FieldSpec, lookup func(string) string) (value string, fromEnv bool) {
+	if v := lookup(spec.Env); v != "" {
+		return v, true
+	}
+	for _, legacy := range spec.LegacyEnv {
+		if v := lookup(legacy); v != "" {
+			if !warnedLegacyEnv[legacy] {
+				log.Printf("skyconfig: %s is deprecated, use %s instead", legacy, spec.Env)
+				warnedLegacyEnv[legacy] = true
+			}
+			return v, true
+		}
+	}
+	return spec.Default, false
+}
+
+// Help looks up the FieldSpec registered for the given dotted Go field
+// path (e.g. "App.APIKey"). It is intended to back a future
+// `skygear-server config help` subcommand.
+func Help(field string) (FieldSpec, bool) {
+	for _, spec := range Fields {
+		if spec.Path == field {
+			return spec, true
+		}
+	}
+	return FieldSpec{}, false
+}
+
+// AllFields returns every registered FieldSpec.
+func AllFields() []FieldSpec {
+	out := make([]FieldSpec, len(Fields))
+	copy(out, Fields)
+	return out
+}
+
+// readRegistryFields resolves every FieldSpec in Fields against the
+// environment and writes it into the matching Configuration field via
+// reflection. It only overwrites a field when a spec resolves to a
+// non-empty value, preserving whatever NewConfiguration already set.
+//
+// A spec that fails its Enum check, its Validate func, or setFieldByPath
+// is skipped rather than aborting the loop, so one bad env var (say a
+// mistyped APNS_ENV) cannot blank out every field registered after it -
+// the old per-field read* methods this replaced were independent of
+// each other in exactly this way. Every failure is still collected and
+// returned, joined, so the caller's log.Print(err) reports all of them.
+func (config *Configuration) readRegistryFields() error {
+	root := reflect.ValueOf(config).Elem()
+	var errs []string
+	for _, spec := range Fields {
+		value, _ := resolveSpec(spec, config.lookupEnv)
+		if value == "" {
+			continue
+		}
+		if len(spec.Enum) > 0 && !stringInSlice(value, spec.Enum) {
+			errs = append(errs, fmt.Sprintf("%s must be one of %v, got %q", spec.Env, spec.Enum, value))
+			continue
+		}
+		if spec.Validate != nil {
+			if err := spec.Validate(value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", spec.Env, err))
+				continue
+			}
+		}
+		if err := setFieldByPath(root, spec.Path, value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", spec.Path, err))
+			continue
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("skyconfig: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func setFieldByPath(root reflect.Value, path string, value string) error {
+	field := root
+	for _, name := range splitPath(path) {
+		field = field.FieldByName(name)
+		if !field.IsValid() {
+			return fmt.Errorf("no such field")
+		}
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int64, reflect.Int:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported field kind %s", field.Kind())
+	}
+	return nil
+}
+
+func splitPath(path string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(path); i++ {
+		if path[i] == '.' {
+			parts = append(parts, path[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, path[start:])
+}
+
+func stringInSlice(needle string, haystack []string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"context"
+	"testing"
+)
+
+// mapConfigSource is a ConfigSource backed by a fixed map, for tests
+// that want to drive ReadFrom without touching the process environment
+// or a file on disk.
+type mapConfigSource map[string]string
+
+func (source mapConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	return map[string]string(source), nil
+}
+
+func (source mapConfigSource) Watch(ctx context.Context) (<-chan Event, error) {
+	return nil, nil
+}
+
+// TestReadRegistryFieldsSkipsOnlyTheBadSpec reproduces the regression
+// where one invalid FieldSpec (an out-of-Enum APNS_ENV) used to abort
+// the whole registry walk, leaving every field registered after it
+// (GCM.APIKey, LOG.Level) at its default instead of the env-provided
+// value.
+func TestReadRegistryFieldsSkipsOnlyTheBadSpec(t *testing.T) {
+	config := NewConfiguration()
+	config.App.Name = "myapp"
+	config.App.APIKey = "api-key"
+	config.App.MasterKey = "master-key"
+
+	err := config.ReadFrom(mapConfigSource{
+		"APNS_ENV":   "bogus",
+		"GCM_APIKEY": "gcm-key",
+		"LOG_LEVEL":  "error",
+	})
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+
+	if config.GCM.APIKey != "gcm-key" {
+		t.Errorf("expected GCM.APIKey to be set despite the bad APNS_ENV, got %q", config.GCM.APIKey)
+	}
+	if config.LOG.Level != "error" {
+		t.Errorf("expected LOG.Level to be set despite the bad APNS_ENV, got %q", config.LOG.Level)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// TestFileConfigSourceDiamondInclude exercises base.yaml including both
+// a.yaml and b.yaml, which both include common.yaml: a cycle detector
+// that tracks "ever loaded" rather than the current include path would
+// reject this, even though no file includes itself.
+func TestFileConfigSourceDiamondInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "common.yaml", "app_name: common\n")
+	writeTestFile(t, dir, "a.yaml", "include: common.yaml\napi_key: from-a\n")
+	writeTestFile(t, dir, "b.yaml", "include: common.yaml\nmaster_key: from-b\n")
+	base := writeTestFile(t, dir, "base.yaml", "include:\n  - a.yaml\n  - b.yaml\n")
+
+	source := NewFileConfigSource(base)
+	values, err := source.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load returned unexpected error for diamond include graph: %v", err)
+	}
+	if values["APP_NAME"] != "common" {
+		t.Errorf("expected APP_NAME from common.yaml, got %q", values["APP_NAME"])
+	}
+	if values["API_KEY"] != "from-a" || values["MASTER_KEY"] != "from-b" {
+		t.Errorf("expected both a.yaml and b.yaml to be loaded, got %+v", values)
+	}
+}
+
+// TestFileConfigSourceTrueCycle verifies a genuine self-including cycle
+// is still rejected.
+func TestFileConfigSourceTrueCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.yaml", "include: b.yaml\n")
+	base := writeTestFile(t, dir, "b.yaml", "include: a.yaml\n")
+
+	source := NewFileConfigSource(base)
+	if _, err := source.Load(context.Background()); err == nil {
+		t.Fatal("expected an include cycle error, got nil")
+	}
+}
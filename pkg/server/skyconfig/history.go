@@ -0,0 +1,602 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a single recorded mutation of a Configuration. Snapshot
+// is a full JSON view of the struct, including fields normally tagged
+// `json:"-"` so that a restore can reproduce the configuration exactly.
+type HistoryEntry struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Author    string    `json:"author,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Snapshot  []byte    `json:"snapshot"`
+}
+
+// ConfigHistoryStore persists and retrieves HistoryEntry records for a
+// Configuration. Implementations must return entries from List in
+// ascending ID order. Append ignores entry.ID and assigns one itself -
+// Postgres via the table's own SERIAL/RETURNING id, the file store under
+// a lock - so that two concurrent Commits can never compute the same
+// next ID and clobber each other's entry.
+type ConfigHistoryStore interface {
+	Append(entry HistoryEntry) (id string, err error)
+	List() ([]HistoryEntry, error)
+	Get(id string) (HistoryEntry, error)
+	Clear() error
+}
+
+// configSnapshotView mirrors Configuration field-for-field but marshals
+// every field to JSON, including the ones Configuration itself hides
+// behind `json:"-"` (TokenStore, AssetStore.Path, APNS cert/key paths,
+// LOG, LogHook, Plugin). It carries the same `secret:"true"` tags as
+// Configuration on MasterKey, TokenStore.Secret, AssetStore.SecretToken,
+// APNS.Key and GCM.APIKey, so redactSecretFields (secrets.go) can redact
+// a view exactly as it does a Configuration - used by DebugConfigHandler
+// (debug.go) to show every field Configuration's own json:"-" tags
+// would otherwise hide, with secrets still redacted. Keep this in sync
+// whenever Configuration grows a field.
+type configSnapshotView struct {
+	HTTP struct {
+		Host string `json:"host"`
+	} `json:"http"`
+	App struct {
+		Name          string `json:"name"`
+		APIKey        string `json:"api_key"`
+		MasterKey     string `json:"master_key" secret:"true"`
+		AccessControl string `json:"access_control"`
+		DevMode       bool   `json:"dev_mode"`
+		CORSHost      string `json:"cors_host"`
+		Slave         bool   `json:"slave"`
+	} `json:"app"`
+	DB struct {
+		ImplName string `json:"implementation"`
+		Option   string `json:"option"`
+	} `json:"database"`
+	TokenStore struct {
+		ImplName string `json:"implementation"`
+		Path     string `json:"path"`
+		Prefix   string `json:"prefix"`
+		Expiry   int64  `json:"expiry"`
+		Secret   string `json:"secret" secret:"true"`
+	} `json:"token_store"`
+	AssetStore struct {
+		ImplName                string `json:"implementation"`
+		Public                  bool   `json:"public"`
+		Path                    string `json:"path"`
+		AccessToken             string `json:"access_key"`
+		SecretToken             string `json:"secret_key" secret:"true"`
+		Region                  string `json:"region"`
+		Bucket                  string `json:"bucket"`
+		CloudAssetHost          string `json:"cloud_asset_host"`
+		CloudAssetToken         string `json:"cloud_asset_token"`
+		CloudAssetPublicPrefix  string `json:"cloud_asset_public_prefix"`
+		CloudAssetPrivatePrefix string `json:"cloud_asset_private_prefix"`
+	} `json:"asset_store"`
+	AssetURLSigner struct {
+		URLPrefix string `json:"url_prefix"`
+		Secret    string `json:"secret"`
+	} `json:"asset_signer"`
+	APNS struct {
+		Enable   bool   `json:"enable"`
+		Env      string `json:"env"`
+		Cert     string `json:"cert"`
+		Key      string `json:"key" secret:"true"`
+		CertPath string `json:"cert_path"`
+		KeyPath  string `json:"key_path"`
+	} `json:"apns"`
+	GCM struct {
+		Enable bool   `json:"enable"`
+		APIKey string `json:"api_key" secret:"true"`
+	} `json:"gcm"`
+	LOG struct {
+		Level        string            `json:"level"`
+		LoggersLevel map[string]string `json:"loggers_level"`
+	} `json:"log"`
+	LogHook struct {
+		SentryDSN   string `json:"sentry_dsn"`
+		SentryLevel string `json:"sentry_level"`
+	} `json:"log_hook"`
+	Plugin map[string]*PluginConfig `json:"plugin"`
+}
+
+// newConfigSnapshotView and applyTo convert field-by-field rather than
+// with a whole-struct assignment (view.App = config.App and so on):
+// several of Configuration's nested anonymous structs carry `json:"-"`
+// tags that configSnapshotView deliberately does not mirror, and Go treats those as distinct types even though the field
+// names and Go types line up. A whole-struct assignment across that
+// mismatch is a compile error, not a runtime one - keep it field-by-field
+// so the two tag sets are free to diverge.
+func newConfigSnapshotView(config *Configuration) configSnapshotView {
+	view := configSnapshotView{}
+	view.HTTP.Host = config.HTTP.Host
+
+	view.App.Name = config.App.Name
+	view.App.APIKey = config.App.APIKey
+	view.App.MasterKey = config.App.MasterKey
+	view.App.AccessControl = config.App.AccessControl
+	view.App.DevMode = config.App.DevMode
+	view.App.CORSHost = config.App.CORSHost
+	view.App.Slave = config.App.Slave
+
+	view.DB.ImplName = config.DB.ImplName
+	view.DB.Option = config.DB.Option
+
+	view.TokenStore.ImplName = config.TokenStore.ImplName
+	view.TokenStore.Path = config.TokenStore.Path
+	view.TokenStore.Prefix = config.TokenStore.Prefix
+	view.TokenStore.Expiry = config.TokenStore.Expiry
+	view.TokenStore.Secret = config.TokenStore.Secret
+
+	view.AssetStore.ImplName = config.AssetStore.ImplName
+	view.AssetStore.Public = config.AssetStore.Public
+	view.AssetStore.Path = config.AssetStore.Path
+	view.AssetStore.AccessToken = config.AssetStore.AccessToken
+	view.AssetStore.SecretToken = config.AssetStore.SecretToken
+	view.AssetStore.Region = config.AssetStore.Region
+	view.AssetStore.Bucket = config.AssetStore.Bucket
+	view.AssetStore.CloudAssetHost = config.AssetStore.CloudAssetHost
+	view.AssetStore.CloudAssetToken = config.AssetStore.CloudAssetToken
+	view.AssetStore.CloudAssetPublicPrefix = config.AssetStore.CloudAssetPublicPrefix
+	view.AssetStore.CloudAssetPrivatePrefix = config.AssetStore.CloudAssetPrivatePrefix
+
+	view.AssetURLSigner.URLPrefix = config.AssetURLSigner.URLPrefix
+	view.AssetURLSigner.Secret = config.AssetURLSigner.Secret
+
+	view.APNS.Enable = config.APNS.Enable
+	view.APNS.Env = config.APNS.Env
+	view.APNS.Cert = config.APNS.Cert
+	view.APNS.Key = config.APNS.Key
+	view.APNS.CertPath = config.APNS.CertPath
+	view.APNS.KeyPath = config.APNS.KeyPath
+
+	view.GCM.Enable = config.GCM.Enable
+	view.GCM.APIKey = config.GCM.APIKey
+
+	view.LOG.Level = config.LOG.Level
+	view.LOG.LoggersLevel = config.LOG.LoggersLevel
+
+	view.LogHook.SentryDSN = config.LogHook.SentryDSN
+	view.LogHook.SentryLevel = config.LogHook.SentryLevel
+
+	view.Plugin = config.Plugin
+	return view
+}
+
+func (view configSnapshotView) applyTo(config *Configuration) {
+	config.HTTP.Host = view.HTTP.Host
+
+	config.App.Name = view.App.Name
+	config.App.APIKey = view.App.APIKey
+	config.App.MasterKey = view.App.MasterKey
+	config.App.AccessControl = view.App.AccessControl
+	config.App.DevMode = view.App.DevMode
+	config.App.CORSHost = view.App.CORSHost
+	config.App.Slave = view.App.Slave
+
+	config.DB.ImplName = view.DB.ImplName
+	config.DB.Option = view.DB.Option
+
+	config.TokenStore.ImplName = view.TokenStore.ImplName
+	config.TokenStore.Path = view.TokenStore.Path
+	config.TokenStore.Prefix = view.TokenStore.Prefix
+	config.TokenStore.Expiry = view.TokenStore.Expiry
+	config.TokenStore.Secret = view.TokenStore.Secret
+
+	config.AssetStore.ImplName = view.AssetStore.ImplName
+	config.AssetStore.Public = view.AssetStore.Public
+	config.AssetStore.Path = view.AssetStore.Path
+	config.AssetStore.AccessToken = view.AssetStore.AccessToken
+	config.AssetStore.SecretToken = view.AssetStore.SecretToken
+	config.AssetStore.Region = view.AssetStore.Region
+	config.AssetStore.Bucket = view.AssetStore.Bucket
+	config.AssetStore.CloudAssetHost = view.AssetStore.CloudAssetHost
+	config.AssetStore.CloudAssetToken = view.AssetStore.CloudAssetToken
+	config.AssetStore.CloudAssetPublicPrefix = view.AssetStore.CloudAssetPublicPrefix
+	config.AssetStore.CloudAssetPrivatePrefix = view.AssetStore.CloudAssetPrivatePrefix
+
+	config.AssetURLSigner.URLPrefix = view.AssetURLSigner.URLPrefix
+	config.AssetURLSigner.Secret = view.AssetURLSigner.Secret
+
+	config.APNS.Enable = view.APNS.Enable
+	config.APNS.Env = view.APNS.Env
+	config.APNS.Cert = view.APNS.Cert
+	config.APNS.Key = view.APNS.Key
+	config.APNS.CertPath = view.APNS.CertPath
+	config.APNS.KeyPath = view.APNS.KeyPath
+
+	config.GCM.Enable = view.GCM.Enable
+	config.GCM.APIKey = view.GCM.APIKey
+
+	config.LOG.Level = view.LOG.Level
+	config.LOG.LoggersLevel = view.LOG.LoggersLevel
+
+	config.LogHook.SentryDSN = view.LogHook.SentryDSN
+	config.LogHook.SentryLevel = view.LogHook.SentryLevel
+
+	config.Plugin = view.Plugin
+}
+
+// actor returns the author tag attached to history entries created by
+// this process, taken from SKYCONFIG_ACTOR. It is empty when unset.
+func actor() string {
+	return os.Getenv("SKYCONFIG_ACTOR")
+}
+
+// SetHistoryStore attaches the ConfigHistoryStore used by Commit,
+// ListHistory, RestoreHistory and ClearHistory. Configurations created
+// via NewConfiguration have no store attached until this is called;
+// Commit is then a no-op.
+func (config *Configuration) SetHistoryStore(store ConfigHistoryStore) {
+	config.historyStore = store
+}
+
+// Commit diffs the current configuration against the most recently
+// recorded snapshot and, when something changed (or no snapshot exists
+// yet), appends a new HistoryEntry tagged with reason and the
+// SKYCONFIG_ACTOR environment variable. It is invoked at the end of
+// ReadFromEnv and is safe to call with no history store attached, in
+// which case it does nothing.
+func (config *Configuration) Commit(reason string) error {
+	if config.historyStore == nil {
+		return nil
+	}
+
+	snapshot, err := json.Marshal(newConfigSnapshotView(config))
+	if err != nil {
+		return fmt.Errorf("skyconfig: failed to snapshot configuration: %v", err)
+	}
+
+	entries, err := config.historyStore.List()
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 && bytes.Equal(entries[len(entries)-1].Snapshot, snapshot) {
+		return nil
+	}
+
+	entry := HistoryEntry{
+		CreatedAt: time.Now().UTC(),
+		Author:    actor(),
+		Reason:    reason,
+		Snapshot:  snapshot,
+	}
+	_, err = config.historyStore.Append(entry)
+	return err
+}
+
+// nextHistoryID computes the next ID from entries, which must already be
+// read under whatever lock guards appends to the same store -
+// FileConfigHistoryStore.Append is the only caller, holding its own
+// lock. PostgresConfigHistoryStore does not use this: it lets the
+// table's SERIAL column assign IDs instead, which is safe under
+// concurrent inserts in a way an app-computed max+1 is not.
+func nextHistoryID(entries []HistoryEntry) string {
+	max := int64(0)
+	for _, entry := range entries {
+		if n, err := strconv.ParseInt(entry.ID, 10, 64); err == nil && n > max {
+			max = n
+		}
+	}
+	return strconv.FormatInt(max+1, 10)
+}
+
+// ListHistory returns every recorded HistoryEntry in ascending order. It
+// returns an error if no history store has been attached.
+func (config *Configuration) ListHistory() ([]HistoryEntry, error) {
+	if config.historyStore == nil {
+		return nil, fmt.Errorf("skyconfig: no history store attached")
+	}
+	return config.historyStore.List()
+}
+
+// RestoreHistory rolls the configuration back to the snapshot recorded
+// under id. It validates the candidate configuration before swapping the
+// fields in place, so a restore can never leave the configuration in an
+// invalid state; the original configuration is left untouched when
+// Validate fails.
+func (config *Configuration) RestoreHistory(id string) error {
+	_, err := config.restoreHistory(id, false)
+	return err
+}
+
+// DryRunRestoreHistory behaves like RestoreHistory but never mutates the
+// configuration. It returns a JSON patch-style diff (field path ->
+// [oldValue, newValue]) describing what RestoreHistory would change.
+func (config *Configuration) DryRunRestoreHistory(id string) (map[string][2]interface{}, error) {
+	return config.restoreHistory(id, true)
+}
+
+func (config *Configuration) restoreHistory(id string, dryRun bool) (map[string][2]interface{}, error) {
+	if config.historyStore == nil {
+		return nil, fmt.Errorf("skyconfig: no history store attached")
+	}
+
+	entry, err := config.historyStore.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var view configSnapshotView
+	if err := json.Unmarshal(entry.Snapshot, &view); err != nil {
+		return nil, fmt.Errorf("skyconfig: failed to parse history entry %s: %v", id, err)
+	}
+
+	candidate := *config
+	view.applyTo(&candidate)
+	if err := candidate.Validate(); err != nil {
+		return nil, fmt.Errorf("skyconfig: refusing to restore history entry %s: %v", id, err)
+	}
+
+	diff := diffSnapshots(newConfigSnapshotView(config), view)
+	if dryRun {
+		return diff, nil
+	}
+
+	view.applyTo(config)
+	return diff, nil
+}
+
+func diffSnapshots(before, after configSnapshotView) map[string][2]interface{} {
+	diff := map[string][2]interface{}{}
+	walkDiff("", reflect.ValueOf(before), reflect.ValueOf(after), diff)
+	return diff
+}
+
+func walkDiff(prefix string, before, after reflect.Value, diff map[string][2]interface{}) {
+	if before.Kind() == reflect.Struct {
+		for i := 0; i < before.NumField(); i++ {
+			name := before.Type().Field(i).Name
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			walkDiff(path, before.Field(i), after.Field(i), diff)
+		}
+		return
+	}
+	a, b := before.Interface(), after.Interface()
+	if !reflect.DeepEqual(a, b) {
+		diff[prefix] = [2]interface{}{a, b}
+	}
+}
+
+// ClearHistory deletes every recorded HistoryEntry. It does not affect
+// the configuration's current in-memory values.
+func (config *Configuration) ClearHistory() error {
+	if config.historyStore == nil {
+		return fmt.Errorf("skyconfig: no history store attached")
+	}
+	return config.historyStore.Clear()
+}
+
+// FileConfigHistoryStore stores history entries as individual JSON files
+// under a directory, one file per entry named "<id>.json".
+type FileConfigHistoryStore struct {
+	Dir string
+
+	// lock serialises Append so that two concurrent Commits cannot list
+	// the same existing entries and compute the same next ID.
+	lock sync.Mutex
+}
+
+// NewFileConfigHistoryStore returns a FileConfigHistoryStore rooted at
+// dir, creating it if it does not already exist.
+func NewFileConfigHistoryStore(dir string) (*FileConfigHistoryStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileConfigHistoryStore{Dir: dir}, nil
+}
+
+func (store *FileConfigHistoryStore) entryPath(id string) string {
+	return filepath.Join(store.Dir, id+".json")
+}
+
+// Append assigns entry the next ID under lock, so that two goroutines
+// of this process appending at the same time cannot observe the same
+// existing entries and overwrite each other. The lock is in-process only:
+// two processes sharing Dir are not serialised, can assign the same ID,
+// and the later rename then replaces the earlier entry. It writes to a
+// temporary file and renames it into place rather than writing
+// entryPath(id) directly, so List never observes a partially-written
+// entry.
+func (store *FileConfigHistoryStore) Append(entry HistoryEntry) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entries, err := store.List()
+	if err != nil {
+		return "", err
+	}
+	entry.ID = nextHistoryID(entries)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	tmp := store.entryPath(entry.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, store.entryPath(entry.ID)); err != nil {
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+func (store *FileConfigHistoryStore) List() ([]HistoryEntry, error) {
+	files, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	entries := make([]HistoryEntry, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(store.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		ni, _ := strconv.ParseInt(entries[i].ID, 10, 64)
+		nj, _ := strconv.ParseInt(entries[j].ID, 10, 64)
+		return ni < nj
+	})
+	return entries, nil
+}
+
+func (store *FileConfigHistoryStore) Get(id string) (HistoryEntry, error) {
+	var entry HistoryEntry
+	b, err := ioutil.ReadFile(store.entryPath(id))
+	if err != nil {
+		return entry, fmt.Errorf("skyconfig: history entry %s not found: %v", id, err)
+	}
+	err = json.Unmarshal(b, &entry)
+	return entry, err
+}
+
+func (store *FileConfigHistoryStore) Clear() error {
+	files, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(store.Dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PostgresConfigHistoryStore stores history entries in a
+// "_config_history" table, reusing the same connection option string
+// (DB.Option) as the rest of Skygear's Postgres-backed stores.
+type PostgresConfigHistoryStore struct {
+	db *sql.DB
+}
+
+// NewPostgresConfigHistoryStore opens a connection using option (the
+// same DSN accepted by Configuration.DB.Option) and ensures the
+// "_config_history" table exists.
+func NewPostgresConfigHistoryStore(option string) (*PostgresConfigHistoryStore, error) {
+	db, err := sql.Open("postgres", option)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS _config_history (
+			id SERIAL PRIMARY KEY,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			author TEXT,
+			reason TEXT,
+			snapshot JSONB NOT NULL
+		)
+	`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("skyconfig: failed to prepare _config_history table: %v", err)
+	}
+
+	return &PostgresConfigHistoryStore{db: db}, nil
+}
+
+// Append lets the _config_history table's SERIAL column assign entry's
+// ID via RETURNING, rather than computing max(id)+1 in the application:
+// two concurrent inserts race safely here because Postgres itself
+// serialises SERIAL allocation, where an app-computed ID followed by an
+// upsert could have two processes agree on the same "next" ID and one
+// silently overwrite the other's entry.
+func (store *PostgresConfigHistoryStore) Append(entry HistoryEntry) (string, error) {
+	var id int64
+	err := store.db.QueryRow(
+		`INSERT INTO _config_history (created_at, author, reason, snapshot) VALUES ($1, $2, $3, $4) RETURNING id`,
+		entry.CreatedAt, entry.Author, entry.Reason, entry.Snapshot,
+	).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (store *PostgresConfigHistoryStore) List() ([]HistoryEntry, error) {
+	rows, err := store.db.Query(`SELECT id, created_at, author, reason, snapshot FROM _config_history ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		var id int64
+		if err := rows.Scan(&id, &entry.CreatedAt, &entry.Author, &entry.Reason, &entry.Snapshot); err != nil {
+			return nil, err
+		}
+		entry.ID = strconv.FormatInt(id, 10)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (store *PostgresConfigHistoryStore) Get(id string) (HistoryEntry, error) {
+	var entry HistoryEntry
+	var rowID int64
+	row := store.db.QueryRow(`SELECT id, created_at, author, reason, snapshot FROM _config_history WHERE id = $1`, id)
+	if err := row.Scan(&rowID, &entry.CreatedAt, &entry.Author, &entry.Reason, &entry.Snapshot); err != nil {
+		return entry, fmt.Errorf("skyconfig: history entry %s not found: %v", id, err)
+	}
+	entry.ID = strconv.FormatInt(rowID, 10)
+	return entry, nil
+}
+
+func (store *PostgresConfigHistoryStore) Clear() error {
+	_, err := store.db.Exec(`DELETE FROM _config_history`)
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestConfig() Configuration {
+	config := NewConfiguration()
+	config.App.APIKey = "api-key"
+	config.App.MasterKey = "master-key"
+	config.TokenStore.Secret = "token-secret"
+	return config
+}
+
+// TestHistoryRoundTrip exercises Commit/ListHistory/RestoreHistory
+// against a FileConfigHistoryStore, the path that used to fail to
+// compile: newConfigSnapshotView/applyTo converting field-by-field
+// relies on every Configuration field making it across unchanged,
+// including ones Configuration itself hides behind `json:"-"`.
+func TestHistoryRoundTrip(t *testing.T) {
+	store, err := NewFileConfigHistoryStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileConfigHistoryStore: %v", err)
+	}
+
+	config := newTestConfig()
+	config.SetHistoryStore(store)
+
+	if err := config.Commit("initial"); err != nil {
+		t.Fatalf("Commit(initial): %v", err)
+	}
+
+	config.App.CORSHost = "https://example.com"
+	config.TokenStore.Path = "data/other-token"
+	if err := config.Commit("changed"); err != nil {
+		t.Fatalf("Commit(changed): %v", err)
+	}
+
+	entries, err := config.ListHistory()
+	if err != nil {
+		t.Fatalf("ListHistory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 history entries, got %d", len(entries))
+	}
+	if entries[0].ID == entries[1].ID {
+		t.Fatalf("expected distinct IDs, got %q twice", entries[0].ID)
+	}
+
+	if err := config.RestoreHistory(entries[0].ID); err != nil {
+		t.Fatalf("RestoreHistory: %v", err)
+	}
+	if config.App.CORSHost != "*" {
+		t.Errorf("expected CORSHost restored to %q, got %q", "*", config.App.CORSHost)
+	}
+	if config.TokenStore.Path != "data/token" {
+		t.Errorf("expected TokenStore.Path (json:\"-\" on Configuration) to round-trip, got %q", config.TokenStore.Path)
+	}
+	if config.App.MasterKey != "master-key" {
+		t.Errorf("expected MasterKey to round-trip, got %q", config.App.MasterKey)
+	}
+}
+
+// TestFileConfigHistoryStoreAppendConcurrent guards against the ID
+// race: nextHistoryID reads List() then Append writes, and two
+// concurrent Appends must never be assigned the same ID.
+func TestFileConfigHistoryStoreAppendConcurrent(t *testing.T) {
+	store, err := NewFileConfigHistoryStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileConfigHistoryStore: %v", err)
+	}
+
+	const n = 20
+	ids := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := store.Append(HistoryEntry{Reason: "concurrent"})
+			if err != nil {
+				t.Errorf("Append: %v", err)
+				return
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if seen[id] {
+			t.Fatalf("ID %q assigned more than once", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("expected %d distinct IDs, got %d", n, len(seen))
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// redactedPlaceholder replaces the value of any field tagged
+// `secret:"true"` wherever Configuration is marshalled to JSON or logged,
+// so that master keys and store credentials never end up in a log file
+// or an admin response body.
+const redactedPlaceholder = "***"
+
+// Redacted returns a copy of config with every field tagged
+// `secret:"true"` (App.MasterKey, TokenStore.Secret,
+// AssetStore.SecretToken, APNS.Key, GCM.APIKey) replaced by "***". It
+// backs Configuration's JSON marshalling; the /_debug/config admin
+// endpoint applies the same redactSecretFields to a configSnapshotView
+// instead (see debug.go).
+func (config Configuration) Redacted() Configuration {
+	redactSecretFields(reflect.ValueOf(&config))
+	return config
+}
+
+func redactSecretFields(ptr reflect.Value) {
+	v := ptr.Elem()
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported (runtime, historyStore): not part of the
+			// serialised view, nothing to redact.
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			redactSecretFields(fv.Addr())
+			continue
+		}
+		if field.Tag.Get("secret") == "true" && fv.Kind() == reflect.String && fv.String() != "" {
+			fv.SetString(redactedPlaceholder)
+		}
+	}
+}
+
+// MarshalJSON implements json.Marshaler so that every caller serialising
+// a Configuration, such as logging, gets secret fields redacted for free
+// instead of having to remember to call Redacted() first. History
+// snapshots and /_debug/config marshal a configSnapshotView rather than
+// a Configuration, so they do not go through this method: snapshots keep
+// secret fields in clear so a restore can reproduce them.
+func (config Configuration) MarshalJSON() ([]byte, error) {
+	type alias Configuration
+	return json.Marshal(alias(config.Redacted()))
+}
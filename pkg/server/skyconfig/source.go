@@ -0,0 +1,320 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/joho/godotenv"
+	"github.com/skygeario/skygear-server/pkg/server/skyconfig/auth"
+)
+
+// EventType describes why a ConfigSource fired an Event on its Watch
+// channel.
+type EventType int
+
+const (
+	// EventChanged indicates one or more keys the source is responsible
+	// for have changed since the last Load.
+	EventChanged EventType = iota
+	// EventError indicates the watch itself failed; Err is set.
+	EventError
+)
+
+// Event is sent on a ConfigSource's Watch channel whenever the
+// underlying store changes.
+type Event struct {
+	Type EventType
+	Err  error
+}
+
+// ConfigSource produces a flat key/value view of configuration, keyed by
+// the same names as FieldSpec.Env, and optionally watches for changes.
+// ReadFrom layers sources in the order given, with later sources
+// overriding earlier ones.
+type ConfigSource interface {
+	Load(ctx context.Context) (map[string]string, error)
+	Watch(ctx context.Context) (<-chan Event, error)
+}
+
+// EnvConfigSource reads from the process environment, i.e. os.Environ.
+// It never fires Watch events since the process environment does not
+// change after start-up.
+type EnvConfigSource struct{}
+
+func (EnvConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	values := map[string]string{}
+	for _, environ := range os.Environ() {
+		for i := 0; i < len(environ); i++ {
+			if environ[i] == '=' {
+				values[environ[:i]] = environ[i+1:]
+				break
+			}
+		}
+	}
+	return values, nil
+}
+
+func (EnvConfigSource) Watch(ctx context.Context) (<-chan Event, error) {
+	return nil, nil
+}
+
+// DotEnvConfigSource reads key/value pairs out of a dotenv-formatted
+// file, defaulting to ".env" to match the behaviour ReadFromEnv has
+// always had.
+type DotEnvConfigSource struct {
+	Path string
+}
+
+func (source DotEnvConfigSource) path() string {
+	if source.Path == "" {
+		return ".env"
+	}
+	return source.Path
+}
+
+func (source DotEnvConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	values, err := godotenv.Read(source.path())
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	return values, err
+}
+
+func (source DotEnvConfigSource) Watch(ctx context.Context) (<-chan Event, error) {
+	return nil, nil
+}
+
+// DefaultSources returns the sources ReadFromEnv has always used: a
+// best-effort .env file followed by the process environment, so that
+// the environment takes precedence.
+func DefaultSources() []ConfigSource {
+	return []ConfigSource{DotEnvConfigSource{}, EnvConfigSource{}}
+}
+
+// configRuntime holds the mutable state ReadFrom and Reload need to
+// share across calls. It is always accessed through a pointer stored in
+// Configuration.runtime so that Configuration itself stays safe to copy
+// by value (NewConfiguration returns one, RestoreHistory copies one).
+type configRuntime struct {
+	lock            sync.RWMutex
+	sources         []ConfigSource
+	env             map[string]string
+	provenance      Provenance
+	reloadCallbacks []func(*Configuration)
+}
+
+// provenanceSource is implemented by a ConfigSource that can explain, per
+// key, where the value it just returned from Load came from. Only
+// FileConfigSource does today; EnvConfigSource and DotEnvConfigSource get
+// a generic tag in ReadFrom instead.
+type provenanceSource interface {
+	Provenance() Provenance
+}
+
+// runtimeInitLock guards the lazy creation of Configuration.runtime in
+// rt(), so that concurrent first calls agree on a single configRuntime
+// (and therefore a single rt.lock).
+var runtimeInitLock sync.Mutex
+
+func (config *Configuration) rt() *configRuntime {
+	runtimeInitLock.Lock()
+	defer runtimeInitLock.Unlock()
+	if config.runtime == nil {
+		config.runtime = &configRuntime{}
+	}
+	return config.runtime
+}
+
+// ReadFrom populates the configuration from sources in order, with
+// values from a later source overriding the same key from an earlier
+// one. It is the generalisation ReadFromEnv is now built on: calling
+// ReadFromEnv() is equivalent to ReadFrom(DefaultSources()...). The
+// resolved sources are retained so Reload can re-run the same pipeline.
+//
+// Loading sources runs unlocked - it only touches the ConfigSources
+// themselves, not config - but everything from there on mutates config
+// in place (the runtime bookkeeping and every Configuration field a
+// read* helper below can touch), so it all runs under a single
+// rt.lock.Lock() for the rest of the call. Without that, a reader
+// accessing a field such as App.APIKey or TokenStore.Secret while a
+// concurrent Reload is in flight races with these writes.
+func (config *Configuration) ReadFrom(sources ...ConfigSource) error {
+	merged := map[string]string{}
+	provenance := Provenance{}
+	for _, source := range sources {
+		values, err := source.Load(context.Background())
+		if err != nil {
+			return err
+		}
+
+		tag := genericSourceTag(source)
+		for k, v := range values {
+			merged[k] = v
+			if ps, ok := source.(provenanceSource); ok {
+				if p, ok := ps.Provenance()[specPathForEnv(k)]; ok {
+					provenance[specPathForEnv(k)] = p
+					continue
+				}
+			}
+			provenance[specPathForEnv(k)] = tag
+		}
+	}
+
+	rt := config.rt()
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rt.sources = sources
+	rt.env = merged
+	rt.provenance = provenance
+
+	config.readHost()
+	if err := config.readRegistryFields(); err != nil {
+		log.Print(err)
+	}
+
+	if config.App.APIKey == "" && config.App.MasterKey == "" && auth.Enabled() {
+		if err := config.bootstrapKeysFromDeviceFlow(); err != nil {
+			log.Printf("skyconfig: device authorization failed: %v", err)
+		}
+	}
+
+	if config.DB.ImplName == "pq" && config.lookupEnv("DATABASE_URL") != "" {
+		config.DB.Option = config.lookupEnv("DATABASE_URL")
+	}
+
+	if tokenStoreSecret := config.lookupEnv("TOKEN_STORE_SECRET"); tokenStoreSecret != "" {
+		config.TokenStore.Secret = tokenStoreSecret
+	} else {
+		config.TokenStore.Secret = config.App.MasterKey
+	}
+
+	config.readAPNS()
+	config.readLog()
+	config.readPlugins()
+
+	if err := config.Commit("ReadFrom"); err != nil {
+		log.Printf("skyconfig: failed to commit configuration history: %v", err)
+	}
+	return nil
+}
+
+// genericSourceTag returns the Provenance tag used for a ConfigSource
+// that does not implement provenanceSource.
+func genericSourceTag(source ConfigSource) string {
+	switch s := source.(type) {
+	case EnvConfigSource:
+		return "env"
+	case DotEnvConfigSource:
+		return fmt.Sprintf("dotenv:%s", s.path())
+	default:
+		return fmt.Sprintf("%T", source)
+	}
+}
+
+// Provenance reports, for every FieldSpec.Path (or raw env var name,
+// when unregistered) resolved by the most recent ReadFrom/ReadFromEnv
+// call, which source set it - e.g. "file:/etc/skygear/prod.yaml:14" or
+// "env". It backs the /_debug/config admin endpoint in debug.go.
+func (config *Configuration) Provenance() Provenance {
+	rt := config.rt()
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+	out := make(Provenance, len(rt.provenance))
+	for k, v := range rt.provenance {
+		out[k] = v
+	}
+	return out
+}
+
+// lookupEnv returns a value merged by the most recent ReadFrom call, or
+// falls back to os.Getenv so that a Configuration which has never had
+// ReadFrom/ReadFromEnv called on it (e.g. one built purely via
+// NewConfiguration in a test) still behaves sensibly. Outside tests,
+// every call site is ReadFrom itself or one of its field-mutating
+// helpers (readHost, readAPNS, readLog, readPlugins, readRegistryFields),
+// invoked while ReadFrom already holds rt.lock for the whole pipeline,
+// so lookupEnv does not
+// take the lock itself - doing so would deadlock against ReadFrom's own
+// write lock held by the same goroutine.
+func (config *Configuration) lookupEnv(key string) string {
+	rt := config.rt()
+	if rt.env != nil {
+		return rt.env[key]
+	}
+	return os.Getenv(key)
+}
+
+// mergedEnv returns every key/value pair visible to the most recent
+// ReadFrom call, or os.Environ as a map when ReadFrom has never run. See
+// lookupEnv: it relies on the same ReadFrom-held lock and does not lock
+// itself.
+func (config *Configuration) mergedEnv() map[string]string {
+	rt := config.rt()
+	if rt.env != nil {
+		return rt.env
+	}
+	values := map[string]string{}
+	for _, environ := range os.Environ() {
+		for i := 0; i < len(environ); i++ {
+			if environ[i] == '=' {
+				values[environ[:i]] = environ[i+1:]
+				break
+			}
+		}
+	}
+	return values
+}
+
+// OnReload registers a callback invoked after every successful Reload,
+// with the lock already released, so subsystems such as the APNS pusher
+// or the asset store can rebind against the new configuration without
+// restarting the process.
+func (config *Configuration) OnReload(callback func(*Configuration)) {
+	rt := config.rt()
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.reloadCallbacks = append(rt.reloadCallbacks, callback)
+}
+
+// Reload re-runs ReadFrom against the sources passed to the most recent
+// ReadFrom/ReadFromEnv call, guarded by the configuration's RWMutex, and
+// then fires every callback registered via OnReload.
+func (config *Configuration) Reload() error {
+	rt := config.rt()
+	rt.lock.RLock()
+	sources := rt.sources
+	rt.lock.RUnlock()
+	if len(sources) == 0 {
+		sources = DefaultSources()
+	}
+
+	if err := config.ReadFrom(sources...); err != nil {
+		return err
+	}
+
+	rt.lock.RLock()
+	callbacks := append([]func(*Configuration){}, rt.reloadCallbacks...)
+	rt.lock.RUnlock()
+	for _, callback := range callbacks {
+		callback(config)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestReadFromConcurrentSafe drives many goroutines through ReadFrom at
+// once. Before the field-mutating portion of ReadFrom ran under
+// rt.lock, this raced under `go test -race`: each goroutine's
+// readHost/readRegistryFields/readAPNS/readLog/readPlugins wrote
+// Configuration fields with no lock held at all. It should run clean
+// now that the whole pipeline, not just rt.sources/env/provenance, is
+// under rt.lock.
+func TestReadFromConcurrentSafe(t *testing.T) {
+	config := NewConfiguration()
+	config.App.Name = "myapp"
+	config.App.APIKey = "api-key"
+	config.App.MasterKey = "master-key"
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := config.ReadFrom(mapConfigSource{
+				"GCM_APIKEY": fmt.Sprintf("gcm-key-%d", i),
+				"LOG_LEVEL":  "error",
+			})
+			if err != nil {
+				t.Errorf("ReadFrom: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if config.LOG.Level != "error" {
+		t.Errorf("expected LOG.Level %q, got %q", "error", config.LOG.Level)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AppOverride mirrors the tenant-relevant subset of Configuration.App.
+// A zero value for any field means "inherit from the process-wide
+// Configuration" rather than "set to the zero value", so a tenant only
+// needs to list the fields it actually overrides. The `path` tag names
+// the Configuration field each override field shadows, the same dotted
+// form as FieldSpec.Path in fields.go; ValidateOverride walks it to
+// reject overrides of a reservedOverrideFields path.
+type AppOverride struct {
+	APIKey        string `path:"App.APIKey"`
+	MasterKey     string `path:"App.MasterKey"`
+	AccessControl string `path:"App.AccessControl"`
+	CORSHost      string `path:"App.CORSHost"`
+	DevMode       *bool  `path:"App.DevMode"`
+}
+
+// reservedOverrideFields are Configuration paths an AppOverride must
+// never shadow because they name transport- or storage-layer resources
+// shared by every tenant in the process.
+var reservedOverrideFields = []string{"DB.Option", "HTTP.Host"}
+
+func isReservedOverrideField(path string) bool {
+	for _, reserved := range reservedOverrideFields {
+		if path == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// AppConfigProvider resolves a per-request Configuration view from the
+// API key on the incoming request, backed by a Registry of
+// database-loaded AppOverride rows. It lets `APIKey`, `MasterKey`,
+// `AccessControl`, `CORSHost` and `DevMode` vary per tenant without
+// running one process per app.
+type AppConfigProvider struct {
+	base     *Configuration
+	registry *Registry
+}
+
+// NewAppConfigProvider wraps base (typically the process-wide
+// Configuration loaded by ReadFromEnv) with a tenant Registry.
+func NewAppConfigProvider(base *Configuration, registry *Registry) *AppConfigProvider {
+	return &AppConfigProvider{base: base, registry: registry}
+}
+
+// NewConfigurationForApp looks up apiKey in the provider's Registry and
+// returns a defensively-copied Configuration with any AppOverride fields
+// applied on top of the process-wide base configuration. When apiKey has
+// no override registered, a copy of the base configuration is returned
+// unchanged. The copy's LOG.LoggersLevel and Plugin maps (and each
+// PluginConfig) are duplicated too, so mutating them does not reach base.
+//
+// The copy is given its own runtime and no history store, rather than
+// the shallow `config := *provider.base` sharing both with base: runtime
+// is a pointer, so without this a call to ReadFrom/Reload/Provenance on
+// the per-tenant Configuration - easy to reach by accident, since
+// they're exported methods on the same type - would mutate state shared
+// with base and every other tenant. Per-tenant configs are not expected
+// to be reloaded or recorded into base's history independently; if that
+// ever becomes a requirement, give them their own history store rather
+// than reinstating the shared one.
+func (provider *AppConfigProvider) NewConfigurationForApp(apiKey string) Configuration {
+	config := *provider.base
+	config.runtime = nil
+	config.historyStore = nil
+	config.LOG.LoggersLevel = make(map[string]string, len(provider.base.LOG.LoggersLevel))
+	for name, level := range provider.base.LOG.LoggersLevel {
+		config.LOG.LoggersLevel[name] = level
+	}
+	config.Plugin = make(map[string]*PluginConfig, len(provider.base.Plugin))
+	for name, plugin := range provider.base.Plugin {
+		if plugin != nil {
+			pluginCopy := *plugin
+			pluginCopy.Args = append([]string(nil), plugin.Args...)
+			plugin = &pluginCopy
+		}
+		config.Plugin[name] = plugin
+	}
+
+	override, ok := provider.registry.Lookup(apiKey)
+	if !ok {
+		return config
+	}
+
+	if override.APIKey != "" {
+		config.App.APIKey = override.APIKey
+	}
+	if override.MasterKey != "" {
+		config.App.MasterKey = override.MasterKey
+	}
+	if override.AccessControl != "" {
+		config.App.AccessControl = override.AccessControl
+	}
+	if override.CORSHost != "" {
+		config.App.CORSHost = override.CORSHost
+	}
+	if override.DevMode != nil {
+		config.App.DevMode = *override.DevMode
+	}
+	return config
+}
+
+// Registry holds every tenant's AppOverride, keyed by API key, loaded
+// from the "_app_config" table. Call Watch to keep it in sync with
+// Postgres via LISTEN/NOTIFY instead of restarting the process whenever
+// a tenant is added or removed.
+type Registry struct {
+	db *sql.DB
+
+	lock      sync.RWMutex
+	overrides map[string]AppOverride
+}
+
+// NewRegistry opens a connection using option (the same DSN accepted by
+// Configuration.DB.Option), ensures the "_app_config" table exists, and
+// performs an initial load.
+func NewRegistry(option string) (*Registry, error) {
+	db, err := sql.Open("postgres", option)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS _app_config (
+			api_key        TEXT PRIMARY KEY,
+			master_key     TEXT NOT NULL,
+			access_control TEXT,
+			cors_host      TEXT,
+			dev_mode       BOOLEAN
+		)
+	`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("skyconfig: failed to prepare _app_config table: %v", err)
+	}
+
+	registry := &Registry{db: db, overrides: map[string]AppOverride{}}
+	if err := registry.reload(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Lookup returns the AppOverride registered for apiKey, if any.
+func (registry *Registry) Lookup(apiKey string) (AppOverride, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	override, ok := registry.overrides[apiKey]
+	return override, ok
+}
+
+func (registry *Registry) reload() error {
+	rows, err := registry.db.Query(`
+		SELECT api_key, master_key, access_control, cors_host, dev_mode FROM _app_config
+	`)
+	if err != nil {
+		return fmt.Errorf("skyconfig: failed to load _app_config: %v", err)
+	}
+	defer rows.Close()
+
+	overrides := map[string]AppOverride{}
+	for rows.Next() {
+		var (
+			apiKey        string
+			masterKey     string
+			accessControl sql.NullString
+			corsHost      sql.NullString
+			devMode       sql.NullBool
+		)
+		if err := rows.Scan(&apiKey, &masterKey, &accessControl, &corsHost, &devMode); err != nil {
+			return err
+		}
+
+		override := AppOverride{APIKey: apiKey, MasterKey: masterKey}
+		if accessControl.Valid {
+			override.AccessControl = accessControl.String
+		}
+		if corsHost.Valid {
+			override.CORSHost = corsHost.String
+		}
+		if devMode.Valid {
+			v := devMode.Bool
+			override.DevMode = &v
+		}
+
+		if err := ValidateOverride(override); err != nil {
+			log.Printf("skyconfig: ignoring _app_config row for %s: %v", apiKey, err)
+			continue
+		}
+		overrides[apiKey] = override
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	registry.lock.Lock()
+	registry.overrides = overrides
+	registry.lock.Unlock()
+	return nil
+}
+
+// Watch blocks, tailing Postgres LISTEN/NOTIFY on the "app_config"
+// channel (expected to be fired by a trigger on _app_config) and
+// reloading the registry whenever a notification arrives, so that
+// adding or removing a tenant does not require a process restart. It
+// returns an error at once if it cannot start listening, and nil when
+// ctx is cancelled; listener, reload and ping errors after that are
+// logged and the loop carries on.
+func (registry *Registry) Watch(ctx context.Context, option string) error {
+	listener := pq.NewListener(option, minReconnectInterval, maxReconnectInterval, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("skyconfig: app_config listener error: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen("app_config"); err != nil {
+		return fmt.Errorf("skyconfig: failed to listen on app_config channel: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-listener.Notify:
+			if err := registry.reload(); err != nil {
+				log.Printf("skyconfig: failed to reload _app_config: %v", err)
+			}
+		case <-time.After(minReconnectInterval):
+			// pq recommends an occasional ping in case a notification
+			// was missed while the connection was silently dropped.
+			if err := listener.Ping(); err != nil {
+				log.Printf("skyconfig: app_config listener ping failed: %v", err)
+			}
+		}
+	}
+}
+
+const (
+	minReconnectInterval = 10 * time.Second
+	maxReconnectInterval = time.Minute
+)
+
+// ValidateOverride checks that override does not set any field that
+// would shadow a reserved, transport-layer Configuration path. It walks
+// override's fields via their `path` tag rather than hard-coding
+// AppOverride's current shape, so a future field that collides with
+// reservedOverrideFields is caught instead of silently passing. It is
+// called both by Registry.reload and by Configuration.Validate, so admin
+// tooling writing a row to _app_config gets the same check by passing
+// the AppOverride it would write to Configuration.Validate.
+func ValidateOverride(override AppOverride) error {
+	value := reflect.ValueOf(override)
+	kind := value.Type()
+	for i := 0; i < kind.NumField(); i++ {
+		field := kind.Field(i)
+		path, ok := field.Tag.Lookup("path")
+		if !ok || !isReservedOverrideField(path) {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		if fieldValue.IsZero() {
+			continue
+		}
+		return fmt.Errorf("skyconfig: override of %s is not allowed, %s is reserved", field.Name, path)
+	}
+	return nil
+}
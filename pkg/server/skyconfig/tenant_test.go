@@ -0,0 +1,72 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import "testing"
+
+// TestValidateOverrideRejectsReservedField proves ValidateOverride's
+// path-tag walk actually rejects a shadowed field, rather than being
+// structurally incapable of ever failing. No field AppOverride has
+// today overlaps reservedOverrideFields - AppOverride is deliberately
+// the tenant-safe subset of App, so by design none of its fields should
+// be reserved - so this reaches in and reserves one of them just for
+// the assertion, restoring the package var afterwards.
+func TestValidateOverrideRejectsReservedField(t *testing.T) {
+	original := reservedOverrideFields
+	reservedOverrideFields = append(append([]string{}, original...), "App.CORSHost")
+	defer func() { reservedOverrideFields = original }()
+
+	if err := ValidateOverride(AppOverride{CORSHost: "https://example.com"}); err == nil {
+		t.Fatal("expected ValidateOverride to reject an override of a reserved field, got nil")
+	}
+
+	if err := ValidateOverride(AppOverride{AccessControl: "role"}); err != nil {
+		t.Errorf("expected a non-reserved override field to pass, got %v", err)
+	}
+}
+
+// TestNewConfigurationForAppIsolatesRuntime verifies a per-tenant
+// Configuration does not share base's runtime pointer: ReadFrom on the
+// tenant copy must not leak into base's env. runtime is only shared
+// when base's runtime was already non-nil at copy time - NewConfiguration
+// never calls rt() - so base.ReadFrom must run first to reproduce the
+// shared-pointer bug this guards against.
+func TestNewConfigurationForAppIsolatesRuntime(t *testing.T) {
+	base := NewConfiguration()
+	base.App.Name = "myapp"
+	base.App.APIKey = "base-api-key"
+	base.App.MasterKey = "base-master-key"
+	if err := base.ReadFrom(mapConfigSource{"CORS_HOST": "https://base.example.com"}); err != nil {
+		t.Fatalf("base.ReadFrom: %v", err)
+	}
+
+	registry := &Registry{overrides: map[string]AppOverride{
+		"tenant-key": {CORSHost: "https://tenant.example.com"},
+	}}
+	provider := NewAppConfigProvider(&base, registry)
+
+	tenantConfig := provider.NewConfigurationForApp("tenant-key")
+	if tenantConfig.App.CORSHost != "https://tenant.example.com" {
+		t.Fatalf("expected override applied, got %q", tenantConfig.App.CORSHost)
+	}
+
+	if err := tenantConfig.ReadFrom(mapConfigSource{"CORS_HOST": "https://from-env.example.com"}); err != nil {
+		t.Fatalf("ReadFrom on tenant config: %v", err)
+	}
+
+	if base.lookupEnv("CORS_HOST") != "https://base.example.com" {
+		t.Errorf("expected base's runtime to be untouched by the tenant config's ReadFrom, got %q", base.lookupEnv("CORS_HOST"))
+	}
+}
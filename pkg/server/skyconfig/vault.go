@@ -0,0 +1,186 @@
+// Copyright 2015-present Oursky Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package skyconfig
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// VaultConfigSource loads secret-typed fields (App.MasterKey,
+// TokenStore.Secret, AssetStore.SecretToken, APNS.Key, GCM.APIKey) from a
+// HashiCorp Vault KV v2 mount, authenticating via AppRole. Each entry
+// under Path is mapped to the env var name obtained by upper-casing its
+// key, e.g. {"master_key": "..."} -> "MASTER_KEY".
+type VaultConfigSource struct {
+	Client   *vaultapi.Client
+	Path     string
+	RoleID   string
+	SecretID string
+
+	leaseDuration int
+}
+
+// NewVaultConfigSource logs into addr using the given AppRole
+// credentials and returns a source reading the KV v2 secret at path
+// (e.g. "secret/data/skygear"). A goroutine is started to renew the
+// resulting token's lease for as long as the process runs.
+func NewVaultConfigSource(ctx context.Context, addr, path, roleID, secretID string) (*VaultConfigSource, error) {
+	client, err := vaultapi.NewClient(&vaultapi.Config{Address: addr})
+	if err != nil {
+		return nil, fmt.Errorf("skyconfig: failed to create vault client: %v", err)
+	}
+
+	source := &VaultConfigSource{Client: client, Path: path, RoleID: roleID, SecretID: secretID}
+	if err := source.login(ctx); err != nil {
+		return nil, err
+	}
+
+	go source.renewLease(ctx)
+	return source, nil
+}
+
+func (source *VaultConfigSource) login(ctx context.Context) error {
+	secret, err := source.Client.Logical().WriteWithContext(ctx, "auth/approle/login", map[string]interface{}{
+		"role_id":   source.RoleID,
+		"secret_id": source.SecretID,
+	})
+	if err != nil {
+		return fmt.Errorf("skyconfig: vault approle login failed: %v", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return fmt.Errorf("skyconfig: vault approle login returned no auth info")
+	}
+
+	source.Client.SetToken(secret.Auth.ClientToken)
+	source.leaseDuration = secret.Auth.LeaseDuration
+	return nil
+}
+
+// renewLease keeps the AppRole token alive for as long as ctx is not
+// cancelled, re-logging in via AppRole whenever the renewal itself
+// fails (e.g. because the lease is no longer renewable).
+func (source *VaultConfigSource) renewLease(ctx context.Context) {
+	for {
+		renewIn := renewalInterval(source.leaseDuration)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(renewIn):
+		}
+
+		secret, err := source.Client.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err != nil || secret == nil || secret.Auth == nil {
+			log.Printf("skyconfig: vault lease renewal failed, re-authenticating: %v", err)
+			if err := source.login(ctx); err != nil {
+				log.Printf("skyconfig: vault re-authentication failed: %v", err)
+			}
+			continue
+		}
+		source.leaseDuration = secret.Auth.LeaseDuration
+	}
+}
+
+func renewalInterval(leaseDuration int) time.Duration {
+	if leaseDuration <= 0 {
+		return time.Minute
+	}
+	// Renew at the lease's two-thirds mark, leaving headroom for retries.
+	return time.Duration(leaseDuration) * time.Second * 2 / 3
+}
+
+func (source *VaultConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	secret, err := source.Client.Logical().ReadWithContext(ctx, source.Path)
+	if err != nil {
+		return nil, fmt.Errorf("skyconfig: vault read failed: %v", err)
+	}
+	if secret == nil {
+		return map[string]string{}, nil
+	}
+
+	data := secret.Data
+	if nested, ok := secret.Data["data"].(map[string]interface{}); ok {
+		// KV v2 wraps the actual secret under a "data" key.
+		data = nested
+	}
+
+	values := map[string]string{}
+	for key, value := range data {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		values[strings.ToUpper(key)] = str
+	}
+	return values, nil
+}
+
+// Watch has no native push mechanism in Vault's KV engine, so it polls
+// Path every minute and reports EventChanged when the secret's version
+// (KV v2) or the value set itself (KV v1) changes.
+func (source *VaultConfigSource) Watch(ctx context.Context) (<-chan Event, error) {
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+		var lastVersion interface{}
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			secret, err := source.Client.Logical().ReadWithContext(ctx, source.Path)
+			if err != nil {
+				select {
+				case events <- Event{Type: EventError, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			if secret == nil {
+				continue
+			}
+
+			var version interface{}
+			if metadata, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+				version = metadata["version"]
+			} else {
+				version = secret.Data
+			}
+
+			if lastVersion != nil && fmt.Sprint(version) != fmt.Sprint(lastVersion) {
+				select {
+				case events <- Event{Type: EventChanged}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			lastVersion = version
+		}
+	}()
+
+	return events, nil
+}